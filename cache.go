@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CacheEntry is a structured record of a single downloaded file, persisted as a row in the
+// sqlite Store. This replaces the original flat filename-per-line cache file so that
+// resumable downloads have somewhere to keep the ETag/Last-Modified needed for range
+// requests, and so downloads can be queried by author/media type/CID instead of just
+// checked for presence.
+type CacheEntry struct {
+	Filename     string `json:"filename"`
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	CID          string `json:"cid,omitempty"` // blob CID, i.e. the digest of the media itself
+	PostCID      string `json:"post_cid,omitempty"`
+	PostURI      string `json:"post_uri,omitempty"`
+	AuthorDID    string `json:"author_did,omitempty"`
+	AuthorHandle string `json:"author_handle,omitempty"`
+	AltText      string `json:"alt_text,omitempty"`
+	LikedAt      string `json:"liked_at,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	DownloadedAt string `json:"downloaded_at,omitempty"` // RFC3339; the age Prune's --older-than-days checks (LikedAt is not consulted)
+	LastAccessed string `json:"last_accessed,omitempty"` // RFC3339; bumped on cache hits, used by evictLRU to pick what to drop first
+}
+
+// loadCache opens the sqlite store (migrating the legacy flat cache file into it on first
+// run) and populates the in-memory downloadedFiles map used for fast cache-hit checks.
+func (mf *MediaFetcher) loadCache() error {
+	store, err := NewSQLiteStore(mf.dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	mf.store = store
+
+	if err := migrateFlatCache(mf.cacheFile, store); err != nil {
+		return fmt.Errorf("failed to migrate legacy cache: %w", err)
+	}
+
+	entries, err := store.All()
+	if err != nil {
+		return fmt.Errorf("failed to load entries from store: %w", err)
+	}
+	mf.downloadedFiles = entries
+
+	fmt.Printf("Cached %d files already downloaded\n", len(entries))
+	return nil
+}
+
+// syncCacheFromDirectory lists the configured Storage backend and adds any objects found there
+// to the cache that aren't already tracked in the store. Useful for recovering from a lost/
+// corrupted store, when files were added manually, or when objects were uploaded directly to
+// a remote backend (S3/WebDAV) outside this tool.
+func (mf *MediaFetcher) syncCacheFromDirectory() error {
+	entries, err := mf.storage.List(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to list storage backend: %w", err)
+	}
+
+	added := 0
+	for _, entry := range entries {
+		if _, ok := mf.downloadedFiles[entry.Key]; !ok {
+			if err := mf.markDownloaded(CacheEntry{Filename: entry.Key, Size: entry.Size}); err != nil {
+				return fmt.Errorf("failed to record synced file %q: %w", entry.Key, err)
+			}
+			added++
+		}
+	}
+	if added > 0 {
+		fmt.Printf("Synced %d files from storage backend to cache\n", added)
+	}
+	return nil
+}
+
+// markDownloaded records a completed download's metadata in the store and the in-memory
+// cache.
+func (mf *MediaFetcher) markDownloaded(entry CacheEntry) error {
+	if err := mf.store.Save(entry); err != nil {
+		return err
+	}
+	mf.cacheMu.Lock()
+	mf.downloadedFiles[entry.Filename] = entry
+	mf.cacheMu.Unlock()
+	return nil
+}
+
+// unmarkDownloaded removes a file's metadata from the store and the in-memory cache, without
+// touching the underlying bytes - used by Prune, which deletes the Storage object itself
+// separately. Once removed, a future FetchAndDownload/WatchLikes pass that re-encounters the
+// same media will see isDownloaded return false and redownload it.
+func (mf *MediaFetcher) unmarkDownloaded(filename string) error {
+	if err := mf.store.Delete(filename); err != nil {
+		return err
+	}
+	mf.cacheMu.Lock()
+	delete(mf.downloadedFiles, filename)
+	mf.cacheMu.Unlock()
+	return nil
+}
+
+// isDownloaded checks if a file has already been downloaded. A hit bumps the entry's
+// LastAccessed time, which evictLRU uses to decide what to drop first under MAX_CACHE_BYTES.
+func (mf *MediaFetcher) isDownloaded(filename string) bool {
+	mf.cacheMu.Lock()
+	entry, ok := mf.downloadedFiles[filename]
+	if ok {
+		entry.LastAccessed = time.Now().Format(time.RFC3339)
+		mf.downloadedFiles[filename] = entry
+	}
+	mf.cacheMu.Unlock()
+
+	if ok {
+		if err := mf.store.Save(entry); err != nil {
+			fmt.Printf("Warning: failed to update last-accessed time for %s: %v\n", filename, err)
+		}
+	}
+	return ok
+}
+
+// cacheEntryFor returns the stored cache entry for a filename, if any, so downloadFile can
+// reuse its ETag/Last-Modified to issue a conditional range request on resume. Entries are
+// only recorded once a download completes, and downloadFile returns on a cache hit before
+// resuming, so a resumed ".part" download finds no entry here and its Range request is sent
+// without If-Range.
+func (mf *MediaFetcher) cacheEntryFor(filename string) (CacheEntry, bool) {
+	mf.cacheMu.Lock()
+	defer mf.cacheMu.Unlock()
+	entry, ok := mf.downloadedFiles[filename]
+	return entry, ok
+}
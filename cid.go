@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// cidFromCDNURL extracts a blob's CID from a Bluesky CDN image URL, which embeds it directly
+// in the path (e.g. https://cdn.bsky.app/img/feed_fullsize/plain/<did>/<cid>@jpeg). This saves
+// a com.atproto.repo.getRecord round trip for the common case; URLs that don't follow this
+// shape (self-hosted PDSes, unknown CDNs) return "" and the caller falls back to header-based
+// hash verification only.
+func cidFromCDNURL(rawURL string) string {
+	segment := rawURL
+	if idx := strings.LastIndex(segment, "/"); idx != -1 {
+		segment = segment[idx+1:]
+	}
+	if idx := strings.IndexByte(segment, '@'); idx != -1 {
+		segment = segment[:idx]
+	}
+	if idx := strings.IndexByte(segment, '?'); idx != -1 {
+		segment = segment[:idx]
+	}
+	if !looksLikeCID(segment) {
+		return ""
+	}
+	return segment
+}
+
+// resolveImageCIDViaRecord is the fallback path for image jobs whose URL doesn't embed its CID
+// the way Bluesky's own CDN does (cidFromCDNURL returned ""): it re-fetches the post record via
+// getPosts and reads the blob ref straight out of app.bsky.embed.images, matching by the
+// image's position in the embed. Returns "" (not an error) whenever any step doesn't pan out -
+// this is best-effort; falling back to header-hash-only verification is fine.
+func (mf *MediaFetcher) resolveImageCIDViaRecord(ctx context.Context, job downloadJob) string {
+	if job.postMeta.postURI == "" || job.imgIndex < 0 {
+		return ""
+	}
+
+	resp, err := bsky.FeedGetPosts(ctx, mf.client, []string{job.postMeta.postURI})
+	if err != nil || len(resp.Posts) == 0 {
+		return ""
+	}
+
+	fp, ok := resp.Posts[0].Record.Val.(*bsky.FeedPost)
+	if !ok || fp.Embed == nil || fp.Embed.EmbedImages == nil {
+		return ""
+	}
+	images := fp.Embed.EmbedImages.Images
+	if job.imgIndex >= len(images) {
+		return ""
+	}
+	img := images[job.imgIndex]
+	if img == nil || img.Image == nil {
+		return ""
+	}
+	return img.Image.Ref.String()
+}
+
+// looksLikeCID does a cheap sanity check that a path segment is plausibly a CIDv1, without
+// fully decoding it.
+func looksLikeCID(s string) bool {
+	return len(s) > 40 && strings.HasPrefix(s, "b")
+}
+
+// cidDigest decodes a CIDv1 (base32-multibase, raw or dag-pb codec, sha2-256 multihash) and
+// returns the raw digest bytes so it can be compared against a freshly computed sha-256 of
+// the downloaded content. Bluesky blob CIDs are always sha2-256, so that's all this supports.
+func cidDigest(cidStr string) ([]byte, error) {
+	if !strings.HasPrefix(cidStr, "b") {
+		return nil, fmt.Errorf("unsupported CID multibase (want base32 'b' prefix): %q", cidStr)
+	}
+	// base32 CIDs are lowercase RFC4648 without padding.
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(cidStr[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to base32-decode CID: %w", err)
+	}
+
+	// CIDv1 = <version varint><codec varint><multihash>, multihash = <code varint><len varint><digest>
+	version, n := binary.Uvarint(raw)
+	if n <= 0 || version != 1 {
+		return nil, fmt.Errorf("unsupported CID version")
+	}
+	raw = raw[n:]
+
+	_, n = binary.Uvarint(raw) // codec (0x55 raw or 0x70 dag-pb) - not needed, both use the digest as-is
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to parse CID codec")
+	}
+	raw = raw[n:]
+
+	hashCode, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to parse multihash code")
+	}
+	raw = raw[n:]
+	if hashCode != 0x12 { // sha2-256
+		return nil, fmt.Errorf("unsupported multihash code 0x%x (only sha2-256 is supported)", hashCode)
+	}
+
+	length, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to parse multihash length")
+	}
+	raw = raw[n:]
+	if uint64(len(raw)) != length {
+		return nil, fmt.Errorf("multihash digest length mismatch: got %d bytes, header says %d", len(raw), length)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DBInfo prints a summary of the sqlite-backed metadata store: counts by author and by media
+// type, and total bytes. With manifest=true it instead dumps every CacheEntry as a JSON array
+// to stdout, for feeding the corpus into other tooling.
+func (mf *MediaFetcher) DBInfo(manifest bool) error {
+	mf.cacheMu.Lock()
+	entries := make([]CacheEntry, 0, len(mf.downloadedFiles))
+	for _, e := range mf.downloadedFiles {
+		entries = append(entries, e)
+	}
+	mf.cacheMu.Unlock()
+
+	if manifest {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	byAuthor := make(map[string]int)
+	byMediaType := make(map[string]int)
+	var totalBytes int64
+	for _, e := range entries {
+		author := e.AuthorHandle
+		if author == "" {
+			author = e.AuthorDID
+		}
+		if author == "" {
+			author = "(unknown)"
+		}
+		byAuthor[author]++
+		byMediaType[mediaTypeFor(e)]++
+		totalBytes += e.Size
+	}
+
+	fmt.Printf("Total files: %d (%s)\n", len(entries), formatBytes(totalBytes))
+
+	fmt.Println("\nBy media type:")
+	for _, mt := range sortedKeys(byMediaType) {
+		fmt.Printf("  %-8s %d\n", mt, byMediaType[mt])
+	}
+
+	fmt.Println("\nBy author:")
+	for _, author := range sortedKeys(byAuthor) {
+		fmt.Printf("  %-32s %d\n", author, byAuthor[author])
+	}
+
+	return nil
+}
+
+// mediaTypeFor classifies an entry as "image", "video", or "unknown", preferring the recorded
+// MimeType and falling back to the file extension for entries downloaded before MimeType was
+// tracked (or synced in from the directory).
+func mediaTypeFor(e CacheEntry) string {
+	switch {
+	case strings.HasPrefix(e.MimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(e.MimeType, "video/"):
+		return "video"
+	}
+	switch strings.ToLower(filepath.Ext(e.Filename)) {
+	case ".mp4", ".ts", ".m3u8", ".mov", ".webm":
+		return "video"
+	case ".jpg", ".jpeg", ".png", ".webp", ".gif":
+		return "image"
+	default:
+		return "unknown"
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for n/div >= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Extract re-emits every cached file whose PostURI matches postURI into outDir, pulling the
+// bytes back from whichever Storage backend they were saved to.
+func (mf *MediaFetcher) Extract(ctx context.Context, postURI, outDir string) (int, error) {
+	mf.cacheMu.Lock()
+	var matches []CacheEntry
+	for _, e := range mf.downloadedFiles {
+		if e.PostURI == postURI {
+			matches = append(matches, e)
+		}
+	}
+	mf.cacheMu.Unlock()
+
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no cached media found for post %s", postURI)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create output dir: %w", err)
+	}
+
+	for _, e := range matches {
+		src, err := mf.storage.Get(ctx, e.Filename)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s from storage: %w", e.Filename, err)
+		}
+		outPath := filepath.Join(outDir, e.Filename)
+		out, err := os.Create(outPath)
+		if err != nil {
+			src.Close()
+			return 0, fmt.Errorf("failed to create %s: %w", outPath, err)
+		}
+		_, copyErr := io.Copy(out, src)
+		src.Close()
+		closeErr := out.Close()
+		if copyErr != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", outPath, copyErr)
+		}
+		if closeErr != nil {
+			return 0, fmt.Errorf("failed to close %s: %w", outPath, closeErr)
+		}
+		fmt.Printf("Extracted %s -> %s\n", e.Filename, outPath)
+	}
+
+	return len(matches), nil
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// downloadJob describes a single unit of media to fetch. Exactly one of imageURL or video
+// is set, matching the embed types FetchAndDownload/downloadPostMedia fan out. postMeta
+// carries the originating post's identity through to the CacheEntry, so Prune can later tell
+// which liked post a file came from. altText/aspectW/aspectH are per-image/video (a post can
+// embed several images, each with its own alt text), so they live here rather than on
+// postMeta.
+type downloadJob struct {
+	imageURL string
+	video    *bsky.EmbedVideo_View
+	postMeta postMeta
+	altText  string
+	aspectW  int64
+	aspectH  int64
+	// imgIndex is this image's position within its post's embed, used as a fallback to find
+	// the matching blob CID via getPosts when cidFromCDNURL can't pull one out of the URL
+	// itself (e.g. a non-Bluesky CDN mirror). -1 for videos, which aren't indexed this way.
+	imgIndex int
+}
+
+// postMeta identifies the liked post a downloadJob's media came from, plus the fields
+// WRITE_SIDECAR captures for dataset/indexing use. likedAt is left blank: FeedGetActorLikes
+// only returns the liked post's view, not the like record itself, so there's no createdAt for
+// the like available without an extra lookup.
+type postMeta struct {
+	postURI      string
+	postCID      string
+	authorDID    string
+	authorHandle string
+	postText     string
+	createdAt    string
+	likedAt      string
+}
+
+// postMetaFor extracts the identity and sidecar-relevant fields a downloadJob needs from the
+// post it came from.
+func postMetaFor(post *bsky.FeedDefs_PostView) postMeta {
+	pm := postMeta{postURI: post.Uri, postCID: post.Cid}
+	if post.Author != nil {
+		pm.authorDID = post.Author.Did
+		pm.authorHandle = post.Author.Handle
+	}
+	if post.Record != nil {
+		if fp, ok := post.Record.Val.(*bsky.FeedPost); ok {
+			pm.postText = fp.Text
+			pm.createdAt = fp.CreatedAt
+		}
+	}
+	return pm
+}
+
+// maxIntegrityAttempts bounds the retry-with-backoff loop in downloadFile when the
+// downloaded bytes fail CID or header-hash verification.
+const maxIntegrityAttempts = 3
+
+// downloadJobResult reports how many files a job downloaded and whether it failed.
+type downloadJobResult struct {
+	downloaded int
+	err        error
+}
+
+// runDownloadJobs fans jobs out across mf.maxConcurrent worker goroutines and collects the
+// total number of files downloaded. It stops launching new jobs once ctx is cancelled but lets
+// in-flight jobs finish.
+func (mf *MediaFetcher) runDownloadJobs(ctx context.Context, jobs []downloadJob) (int, error) {
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	workers := mf.maxConcurrent
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	jobCh := make(chan downloadJob)
+	results := make(chan downloadJobResult)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				var n int
+				var err error
+				if job.video != nil {
+					n, err = mf.downloadVideoJob(ctx, job)
+				} else {
+					n, err = mf.downloadFile(ctx, job, "image")
+				}
+				results <- downloadJobResult{downloaded: n, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobCh)
+		for _, job := range jobs {
+			select {
+			case <-ctx.Done():
+				return
+			case jobCh <- job:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	total := 0
+	var firstErr error
+	for res := range results {
+		total += res.downloaded
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	return total, firstErr
+}
+
+// downloadPostMedia downloads any media from a single post's embed, running its jobs through
+// the same worker pool as FetchAndDownload. Used by WatchLikes and WatchFirehose, where posts
+// arrive one at a time.
+func (mf *MediaFetcher) downloadPostMedia(post *bsky.FeedDefs_PostView) (int, error) {
+	jobs := jobsForEmbed(post.Embed, -1, postMetaFor(post))
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+	return mf.runDownloadJobs(context.Background(), jobs)
+}
+
+// jobsForEmbed flattens a post embed (including the record+media combination) into download
+// jobs. A negative limit means "no limit" (used outside the batch FetchAndDownload loop).
+func jobsForEmbed(embed *bsky.FeedDefs_PostView_Embed, limit int, meta postMeta) []downloadJob {
+	if embed == nil {
+		return nil
+	}
+
+	var jobs []downloadJob
+	add := func(imgs []*bsky.EmbedImages_ViewImage, video *bsky.EmbedVideo_View) {
+		for i, img := range imgs {
+			if limit >= 0 && len(jobs) >= limit {
+				return
+			}
+			job := downloadJob{imageURL: img.Fullsize, postMeta: meta, altText: img.Alt, imgIndex: i}
+			if img.AspectRatio != nil {
+				job.aspectW = img.AspectRatio.Width
+				job.aspectH = img.AspectRatio.Height
+			}
+			jobs = append(jobs, job)
+		}
+		if video != nil && (limit < 0 || len(jobs) < limit) {
+			alt := ""
+			if video.Alt != nil {
+				alt = *video.Alt
+			}
+			job := downloadJob{video: video, postMeta: meta, altText: alt, imgIndex: -1}
+			if video.AspectRatio != nil {
+				job.aspectW = video.AspectRatio.Width
+				job.aspectH = video.AspectRatio.Height
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	if embed.EmbedImages_View != nil {
+		add(embed.EmbedImages_View.Images, nil)
+	}
+	if embed.EmbedVideo_View != nil {
+		add(nil, embed.EmbedVideo_View)
+	}
+	if embed.EmbedRecordWithMedia_View != nil && embed.EmbedRecordWithMedia_View.Media != nil {
+		media := embed.EmbedRecordWithMedia_View.Media
+		if media.EmbedImages_View != nil {
+			add(media.EmbedImages_View.Images, nil)
+		}
+		if media.EmbedVideo_View != nil {
+			add(nil, media.EmbedVideo_View)
+		}
+	}
+	return jobs
+}
+
+// downloadVideoJob downloads an HLS video embed, using the pure-Go segment downloader by
+// default and falling back to shelling out to ffmpeg when mf.useFFmpeg is set (USE_FFMPEG=1),
+// e.g. as an escape hatch for playlists the in-process downloader can't handle yet.
+func (mf *MediaFetcher) downloadVideoJob(ctx context.Context, job downloadJob) (int, error) {
+	if mf.useFFmpeg {
+		return mf.downloadVideoFFmpeg(ctx, job)
+	}
+	return mf.downloadVideoHLS(ctx, job)
+}
+
+// downloadVideoFFmpeg downloads an HLS video stream via ffmpeg, muxing it to mp4. Kept as an
+// optional fallback (USE_FFMPEG=1) for environments with ffmpeg on PATH that want its more
+// permissive HLS/codec handling.
+//
+// Unlike downloadFile, this doesn't verify the result against video.Cid: ffmpeg remuxes the
+// HLS segments into a fresh mp4 container, so the output bytes never match the original
+// blob's digest even on a perfect download.
+func (mf *MediaFetcher) downloadVideoFFmpeg(ctx context.Context, job downloadJob) (int, error) {
+	video := job.video
+	if video.Playlist == "" {
+		return 0, nil
+	}
+
+	// Generate filename from URL hash
+	hash := sha256.Sum256([]byte(video.Playlist))
+	cacheKey := hex.EncodeToString(hash[:])
+	filename := cacheKey + ".mp4"
+
+	// Check if already downloaded
+	if mf.isDownloaded(filename) {
+		fmt.Printf("Cache hit: %s\n", filename)
+		return 0, nil
+	}
+
+	mf.pin(filename)
+	defer mf.unpin(filename)
+
+	fmt.Printf("Downloading video via ffmpeg: %s\n", video.Playlist)
+
+	// Mux straight to stdout (fragmented so the mp4 muxer doesn't need a seekable output) and
+	// pipe it directly into Storage.Put, so the bytes stream straight to S3/WebDAV without a
+	// local staging copy. -f mp4 is required since ffmpeg can't infer a container from "-".
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", video.Playlist, "-c", "copy",
+		"-f", "mp4", "-movflags", "frag_keyframe+empty_moov", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ffmpeg stdout: %w", err)
+	}
+	cmd.Stderr = nil
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	putErrCh := make(chan error, 1)
+	go func() {
+		putErrCh <- mf.storage.Put(ctx, filename, stdout)
+	}()
+
+	waitErr := cmd.Wait()
+	putErr := <-putErrCh
+	if waitErr != nil {
+		return 0, fmt.Errorf("ffmpeg failed: %w", waitErr)
+	}
+	if putErr != nil {
+		return 0, fmt.Errorf("failed to store %s: %w", filename, putErr)
+	}
+
+	// Mark as downloaded in cache, then best-effort write the sidecar alongside it - see
+	// maybeWriteSidecar's doc comment for what happens if that write fails.
+	entry := CacheEntry{
+		Filename:     filename,
+		URL:          video.Playlist,
+		PostCID:      job.postMeta.postCID,
+		PostURI:      job.postMeta.postURI,
+		AuthorDID:    job.postMeta.authorDID,
+		AuthorHandle: job.postMeta.authorHandle,
+		AltText:      job.altText,
+		MimeType:     "video/mp4",
+		DownloadedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := mf.markDownloaded(entry); err != nil {
+		fmt.Printf("Warning: failed to update cache: %v\n", err)
+	}
+	if err := mf.maybeWriteSidecar(ctx, sidecarFor(job, filename, video.Playlist, "")); err != nil {
+		fmt.Printf("Warning: failed to write sidecar: %v\n", err)
+	}
+	if err := mf.evictLRU(ctx); err != nil {
+		fmt.Printf("Warning: cache eviction failed: %v\n", err)
+	}
+
+	fmt.Printf("Saved: %s\n", filename)
+	return 1, nil
+}
+
+// downloadFile downloads a single media URL, resuming a previous partial download when
+// possible. The file is first written to a ".part" sibling; on success it's stored under its
+// final name via the Storage backend (see finalizeDownload) and recorded in the cache, so a
+// process that's killed mid-download leaves behind only the partial file, not a corrupt
+// "complete" one. The downloaded bytes are verified against the blob's CID (when one can be
+// recovered from the URL or, failing that, from the post record via getPosts) and any
+// x-goog-hash/Digest/Content-MD5 response headers; a mismatch deletes the file and retries
+// with exponential backoff rather than silently caching truncated/corrupt media.
+func (mf *MediaFetcher) downloadFile(ctx context.Context, job downloadJob, mediaType string) (int, error) {
+	url := job.imageURL
+
+	wantCID := cidFromCDNURL(url)
+	if wantCID == "" {
+		wantCID = mf.resolveImageCIDViaRecord(ctx, job)
+	}
+
+	//	Cache key: the content CID when we have one, so the same blob always maps to the same
+	//	filename regardless of which post/CDN URL it was seen through - falls back to a hash of
+	//	the URL itself when no CID could be resolved.
+	cacheKey := wantCID
+	if cacheKey == "" {
+		hash := sha256.Sum256([]byte(url))
+		cacheKey = hex.EncodeToString(hash[:])
+	}
+	//	Determine file extension
+	ext := filepath.Ext(url)
+	if ext == "" {
+		if strings.Contains(url, "m3u8") {
+			ext = ".m3u8"
+		} else if mediaType == "image" {
+			ext = ".png"
+		} else {
+			ext = ".mp4"
+		}
+	}
+	filename := cacheKey + ext
+	finalPath := filepath.Join(mf.downloadDir, filename)
+	partPath := finalPath + ".part"
+
+	//	Check if already cached
+	if mf.isDownloaded(filename) {
+		fmt.Printf("Cache hit: %s\n", filename)
+		return 0, nil // Return 0 because we didn't download a new file
+	}
+
+	mf.pin(filename)
+	defer mf.unpin(filename)
+
+	backoff := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 1; attempt <= maxIntegrityAttempts; attempt++ {
+		n, err := mf.attemptDownloadFile(ctx, url, filename, partPath, wantCID, job)
+		if err == nil {
+			return n, nil
+		}
+		lastErr = err
+		fmt.Printf("Download attempt %d/%d failed for %s: %v\n", attempt, maxIntegrityAttempts, filename, err)
+
+		if attempt == maxIntegrityAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return 0, fmt.Errorf("failed to download %s after %d attempts: %w", url, maxIntegrityAttempts, lastErr)
+}
+
+// attemptDownloadFile performs one resumable download + verification pass. On integrity
+// failure it deletes the partial/final file so the next attempt starts clean.
+func (mf *MediaFetcher) attemptDownloadFile(ctx context.Context, url, filename, partPath, wantCID string, job downloadJob) (int, error) {
+	var offset int64
+	if fi, err := os.Stat(partPath); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if entry, ok := mf.cacheEntryFor(filename); ok {
+			if entry.ETag != "" {
+				req.Header.Set("If-Range", entry.ETag)
+			} else if entry.LastModified != "" {
+				req.Header.Set("If-Range", entry.LastModified)
+			}
+		}
+		fmt.Printf("Resuming download from byte %d: %s\n", offset, url)
+	} else {
+		fmt.Printf("Downloading: %s\n", url)
+	}
+
+	resp, err := mf.doRequestWithRetry(ctx, req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	openFlag := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Server ignored our range request (or there was nothing to resume); start over.
+		offset = 0
+		openFlag |= os.O_TRUNC
+	case http.StatusPartialContent:
+		openFlag |= os.O_APPEND
+	default:
+		return 0, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	out, err := os.OpenFile(partPath, openFlag, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open partial file: %w", err)
+	}
+
+	// Content-MD5/Digest/x-goog-hash and the CID describe the whole object. For a fresh
+	// download we can verify them as the bytes stream through; for a resumed (206) download
+	// only the tail bytes pass through here, so verification happens in a second pass over the
+	// fully assembled file below instead - a resume must be checked end-to-end like any other
+	// download, not just on the bytes this particular attempt happened to fetch.
+	resumed := offset > 0 && resp.StatusCode == http.StatusPartialContent
+
+	headerChecks := parseContentHashes(resp.Header)
+	var sha256Sum hash.Hash
+	if wantCID != "" {
+		sha256Sum = sha256.New()
+	}
+
+	var sideWriters []io.Writer
+	for _, c := range headerChecks {
+		sideWriters = append(sideWriters, c.h)
+	}
+	if sha256Sum != nil {
+		sideWriters = append(sideWriters, sha256Sum)
+	}
+
+	var body io.Reader = resp.Body
+	if len(sideWriters) > 0 && !resumed {
+		body = io.TeeReader(resp.Body, io.MultiWriter(sideWriters...))
+	}
+
+	written, copyErr := io.Copy(out, body)
+	closeErr := out.Close()
+	if copyErr != nil {
+		return 0, fmt.Errorf("failed to write file: %w", copyErr)
+	}
+	if closeErr != nil {
+		return 0, fmt.Errorf("failed to close file: %w", closeErr)
+	}
+
+	totalSize := offset + written
+	if resp.ContentLength >= 0 {
+		expected := resp.ContentLength
+		if resp.StatusCode == http.StatusPartialContent {
+			expected += offset
+		}
+		if totalSize != expected {
+			mf.discardFailedDownload(partPath)
+			return 0, fmt.Errorf("short download: got %d bytes, expected %d", totalSize, expected)
+		}
+	}
+
+	if len(sideWriters) > 0 && resumed {
+		if err := hashAssembledFile(partPath, sideWriters); err != nil {
+			mf.discardFailedDownload(partPath)
+			return 0, fmt.Errorf("failed to verify assembled file: %w", err)
+		}
+	}
+
+	if name, err := verifyContentHashes(headerChecks); err != nil {
+		mf.discardFailedDownload(partPath)
+		return 0, fmt.Errorf("integrity check failed (%s): %w", name, err)
+	}
+
+	if sha256Sum != nil {
+		wantDigest, err := cidDigest(wantCID)
+		if err != nil {
+			fmt.Printf("Warning: could not decode CID %s, skipping CID verification: %v\n", wantCID, err)
+		} else if !hashesEqual(sha256Sum.Sum(nil), wantDigest) {
+			mf.discardFailedDownload(partPath)
+			return 0, fmt.Errorf("CID mismatch for %s: content does not match blob digest", url)
+		}
+	}
+
+	if err := mf.finalizeDownload(ctx, partPath, filename); err != nil {
+		return 0, err
+	}
+
+	entry := CacheEntry{
+		Filename:     filename,
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         totalSize,
+		CID:          wantCID,
+		PostCID:      job.postMeta.postCID,
+		PostURI:      job.postMeta.postURI,
+		AuthorDID:    job.postMeta.authorDID,
+		AuthorHandle: job.postMeta.authorHandle,
+		AltText:      job.altText,
+		MimeType:     resp.Header.Get("Content-Type"),
+		DownloadedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := mf.markDownloaded(entry); err != nil {
+		fmt.Printf("Warning: failed to update cache: %v\n", err)
+	}
+	if err := mf.maybeWriteSidecar(ctx, sidecarFor(job, filename, url, wantCID)); err != nil {
+		fmt.Printf("Warning: failed to write sidecar: %v\n", err)
+	}
+	if err := mf.evictLRU(ctx); err != nil {
+		fmt.Printf("Warning: cache eviction failed: %v\n", err)
+	}
+
+	fmt.Printf("Saved: %s\n", filename)
+	return 1, nil // Return 1 because we successfully downloaded a new file
+}
+
+// finalizeDownload hands a verified local ".part" file off to the configured Storage backend
+// under its final key, then removes the local scratch copy. Resumable range requests always
+// land on local disk first (remote backends don't support appending to an in-progress
+// upload), so this is the one place every backend - local, S3, WebDAV - converges on.
+func (mf *MediaFetcher) finalizeDownload(ctx context.Context, partPath, key string) error {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return fmt.Errorf("failed to reopen finished download: %w", err)
+	}
+	defer part.Close()
+
+	if err := mf.storage.Put(ctx, key, part); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	if err := os.Remove(partPath); err != nil {
+		fmt.Printf("Warning: failed to remove scratch file %s: %v\n", partPath, err)
+	}
+	return nil
+}
+
+// hashAssembledFile re-reads path from the start and feeds its full contents through writers
+// (header-hash and/or CID sha256 accumulators), for when the bytes couldn't be hashed as they
+// streamed in - i.e. a resumed download, where only the tail passed through this attempt.
+func hashAssembledFile(path string, writers []io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen assembled file: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return fmt.Errorf("failed to hash assembled file: %w", err)
+	}
+	return nil
+}
+
+// discardFailedDownload removes a partial file that failed verification so the next retry
+// starts from a clean slate instead of resuming corrupt bytes.
+func (mf *MediaFetcher) discardFailedDownload(partPath string) {
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: failed to remove corrupt partial file %s: %v\n", partPath, err)
+	}
+}
+
+// maxConcurrentDownloadsFromEnv parses MAX_CONCURRENT_DOWNLOADS, defaulting to 4 workers.
+func maxConcurrentDownloadsFromEnv(raw string) int {
+	if raw == "" {
+		return 4
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 4
+	}
+	return n
+}
+
+// maxCacheBytesFromEnv parses MAX_CACHE_BYTES, defaulting to 10 GB. A value of 0 disables
+// eviction entirely ("permanent archive" mode); a negative or unparseable value also falls
+// back to the default rather than disabling eviction by accident.
+func maxCacheBytesFromEnv(raw string) int64 {
+	const defaultMaxCacheBytes = 10 * 1024 * 1024 * 1024
+	if raw == "" {
+		return defaultMaxCacheBytes
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n < 0 {
+		return defaultMaxCacheBytes
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// pin marks filename as currently being written, excluding it from evictLRU's consideration
+// no matter how its (possibly nonexistent yet) access time would otherwise rank it. Callers
+// pin once the cache-hit check returns false and unpin via defer once the download (success
+// or failure) is done.
+func (mf *MediaFetcher) pin(filename string) {
+	mf.pinnedMu.Lock()
+	defer mf.pinnedMu.Unlock()
+	mf.pinned[filename] = true
+}
+
+// unpin releases a filename pinned by pin.
+func (mf *MediaFetcher) unpin(filename string) {
+	mf.pinnedMu.Lock()
+	defer mf.pinnedMu.Unlock()
+	delete(mf.pinned, filename)
+}
+
+func (mf *MediaFetcher) isPinned(filename string) bool {
+	mf.pinnedMu.Lock()
+	defer mf.pinnedMu.Unlock()
+	return mf.pinned[filename]
+}
+
+// evictLRU deletes the least-recently-accessed cached files, oldest first, until the total
+// size tracked in the store is at or below mf.maxCacheBytes. A cap of 0 disables eviction
+// entirely, for "permanent archive" setups where DOWNLOAD_DIR isn't meant to be pruned
+// automatically. Called after every successful download, same as maybeWriteSidecar.
+func (mf *MediaFetcher) evictLRU(ctx context.Context) error {
+	if mf.maxCacheBytes <= 0 {
+		return nil
+	}
+
+	mf.cacheMu.Lock()
+	entries := make([]CacheEntry, 0, len(mf.downloadedFiles))
+	var total int64
+	for _, e := range mf.downloadedFiles {
+		entries = append(entries, e)
+		total += e.Size
+	}
+	mf.cacheMu.Unlock()
+
+	if total <= mf.maxCacheBytes {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return lastAccessTime(entries[i]).Before(lastAccessTime(entries[j]))
+	})
+
+	evicted := 0
+	for _, e := range entries {
+		if total <= mf.maxCacheBytes {
+			break
+		}
+		if mf.isPinned(e.Filename) {
+			continue
+		}
+		if err := mf.storage.Delete(ctx, e.Filename); err != nil {
+			fmt.Printf("Warning: failed to evict %s: %v\n", e.Filename, err)
+			continue
+		}
+		if err := mf.unmarkDownloaded(e.Filename); err != nil {
+			fmt.Printf("Warning: failed to remove evicted entry %s from cache: %v\n", e.Filename, err)
+		}
+		total -= e.Size
+		evicted++
+	}
+	if evicted > 0 {
+		fmt.Printf("Evicted %d file(s) to stay under the %d byte cache cap\n", evicted, mf.maxCacheBytes)
+	}
+	return nil
+}
+
+// lastAccessTime returns the best-known last-access time for an entry: LastAccessed (bumped on
+// cache hits) when available, falling back to DownloadedAt, or the zero time if neither parses
+// - which sorts an entry first, i.e. most eligible for eviction.
+func lastAccessTime(e CacheEntry) time.Time {
+	if e.LastAccessed != "" {
+		if t, err := time.Parse(time.RFC3339, e.LastAccessed); err == nil {
+			return t
+		}
+	}
+	if e.DownloadedAt != "" {
+		if t, err := time.Parse(time.RFC3339, e.DownloadedAt); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
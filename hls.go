@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsVariant is one rendition listed in an HLS master playlist.
+type hlsVariant struct {
+	url       string
+	bandwidth int
+}
+
+// hlsSegment is one media segment listed in an HLS media playlist, resolved to an absolute
+// URL. hasRange (with rangeLen/rangeOff) is set when the playlist used #EXT-X-BYTERANGE to point at a slice of a
+// shared resource rather than giving the segment its own URI.
+type hlsSegment struct {
+	url      string
+	hasRange bool
+	rangeLen int64
+	rangeOff int64
+}
+
+// maxHLSBandwidthFromEnv parses MAX_HLS_BANDWIDTH (bits/sec); 0 means "no cap, pick highest".
+func maxHLSBandwidthFromEnv(raw string) int {
+	if raw == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// downloadVideoHLS downloads an HLS video embed without shelling out to ffmpeg: it resolves
+// the playlist to a flat list of media segments, downloads them concurrently across
+// mf.maxConcurrent workers, and concatenates them in order. MPEG-TS segments (what Bluesky's
+// CDN serves) can be concatenated directly into a single playable .ts file - no container
+// remux needed, unlike ffmpeg's fMP4 output.
+func (mf *MediaFetcher) downloadVideoHLS(ctx context.Context, job downloadJob) (int, error) {
+	video := job.video
+	if video.Playlist == "" {
+		return 0, nil
+	}
+
+	hash := sha256.Sum256([]byte(video.Playlist))
+	filename := hex.EncodeToString(hash[:]) + ".ts"
+
+	if mf.isDownloaded(filename) {
+		fmt.Printf("Cache hit: %s\n", filename)
+		return 0, nil
+	}
+
+	segments, err := mf.resolveHLSSegments(ctx, video.Playlist)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve HLS playlist: %w", err)
+	}
+	if len(segments) == 0 {
+		return 0, fmt.Errorf("HLS playlist for %s has no segments", video.Playlist)
+	}
+
+	mf.pin(filename)
+	defer mf.unpin(filename)
+
+	fmt.Printf("Downloading HLS video (%d segments): %s\n", len(segments), video.Playlist)
+
+	data, err := mf.fetchHLSSegments(ctx, segments)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download HLS segments: %w", err)
+	}
+
+	scratchPath := filepath.Join(mf.downloadDir, filename+".part")
+	out, err := os.Create(scratchPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create scratch file: %w", err)
+	}
+	for _, seg := range data {
+		if _, err := out.Write(seg); err != nil {
+			out.Close()
+			os.Remove(scratchPath)
+			return 0, fmt.Errorf("failed to write segment: %w", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(scratchPath)
+		return 0, fmt.Errorf("failed to close scratch file: %w", err)
+	}
+
+	if err := mf.finalizeDownload(ctx, scratchPath, filename); err != nil {
+		return 0, err
+	}
+
+	entry := CacheEntry{
+		Filename:     filename,
+		URL:          video.Playlist,
+		PostCID:      job.postMeta.postCID,
+		PostURI:      job.postMeta.postURI,
+		AuthorDID:    job.postMeta.authorDID,
+		AuthorHandle: job.postMeta.authorHandle,
+		AltText:      job.altText,
+		MimeType:     "video/mp2t",
+		DownloadedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := mf.markDownloaded(entry); err != nil {
+		fmt.Printf("Warning: failed to update cache: %v\n", err)
+	}
+	if err := mf.maybeWriteSidecar(ctx, sidecarFor(job, filename, video.Playlist, "")); err != nil {
+		fmt.Printf("Warning: failed to write sidecar: %v\n", err)
+	}
+	if err := mf.evictLRU(ctx); err != nil {
+		fmt.Printf("Warning: cache eviction failed: %v\n", err)
+	}
+
+	fmt.Printf("Saved: %s\n", filename)
+	return 1, nil
+}
+
+// resolveHLSSegments fetches playlistURL and, if it's a master playlist, follows the highest-
+// bandwidth variant (capped by MAX_HLS_BANDWIDTH if set) to the underlying media playlist.
+func (mf *MediaFetcher) resolveHLSSegments(ctx context.Context, playlistURL string) ([]hlsSegment, error) {
+	body, err := mf.fetchPlaylist(ctx, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if isMasterPlaylist(body) {
+		variants, err := parseMasterPlaylist(body, playlistURL)
+		if err != nil {
+			return nil, err
+		}
+		if len(variants) == 0 {
+			return nil, fmt.Errorf("master playlist has no variants")
+		}
+		variant := pickHLSVariant(variants, maxHLSBandwidthFromEnv(os.Getenv("MAX_HLS_BANDWIDTH")))
+		playlistURL = variant.url
+		body, err = mf.fetchPlaylist(ctx, playlistURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseMediaPlaylist(body, playlistURL)
+}
+
+// pickHLSVariant returns the highest-bandwidth variant at or below maxBandwidth, or the
+// highest-bandwidth variant overall if maxBandwidth is 0 (no cap) or nothing qualifies.
+func pickHLSVariant(variants []hlsVariant, maxBandwidth int) hlsVariant {
+	best := variants[0]
+	bestCapped := variants[0]
+	haveCapped := false
+	for _, v := range variants {
+		if v.bandwidth > best.bandwidth {
+			best = v
+		}
+		if maxBandwidth > 0 && v.bandwidth <= maxBandwidth {
+			if !haveCapped || v.bandwidth > bestCapped.bandwidth {
+				bestCapped = v
+				haveCapped = true
+			}
+		}
+	}
+	if maxBandwidth > 0 && haveCapped {
+		return bestCapped
+	}
+	return best
+}
+
+// fetchPlaylist downloads an .m3u8 file's body.
+func (mf *MediaFetcher) fetchPlaylist(ctx context.Context, playlistURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := mf.doRequestWithRetry(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch playlist: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("playlist fetch returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read playlist: %w", err)
+	}
+	return string(body), nil
+}
+
+func isMasterPlaylist(body string) bool {
+	return strings.Contains(body, "#EXT-X-STREAM-INF")
+}
+
+// parseMasterPlaylist extracts each #EXT-X-STREAM-INF variant's BANDWIDTH and following URI,
+// resolved against baseURL.
+func parseMasterPlaylist(body, baseURL string) ([]hlsVariant, error) {
+	var variants []hlsVariant
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	var pendingBandwidth int
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			pendingBandwidth = parseHLSAttrInt(line, "BANDWIDTH")
+		case line == "" || strings.HasPrefix(line, "#"):
+			// other tag or blank line, ignore
+		default:
+			resolved, err := resolveHLSURL(baseURL, line)
+			if err != nil {
+				return nil, err
+			}
+			variants = append(variants, hlsVariant{url: resolved, bandwidth: pendingBandwidth})
+			pendingBandwidth = 0
+		}
+	}
+	return variants, scanner.Err()
+}
+
+// parseMediaPlaylist extracts each segment URI, resolved against baseURL, along with any
+// #EXT-X-BYTERANGE preceding it. An offset-less BYTERANGE ("LENGTH" with no "@OFFSET")
+// applies immediately after the previous segment taken from the same URI, per the HLS spec.
+func parseMediaPlaylist(body, baseURL string) ([]hlsSegment, error) {
+	var segments []hlsSegment
+	lastEndByURL := make(map[string]int64)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	var pendingRange *hlsSegment
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			length, offset, hasOffset := parseHLSByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"))
+			pendingRange = &hlsSegment{hasRange: true, rangeLen: length, rangeOff: offset}
+			if !hasOffset {
+				pendingRange.rangeOff = -1 // resolved once we know the segment's URI
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+			// other tag or blank line, ignore
+		default:
+			resolved, err := resolveHLSURL(baseURL, line)
+			if err != nil {
+				return nil, err
+			}
+			seg := hlsSegment{url: resolved}
+			if pendingRange != nil {
+				seg.hasRange = true
+				seg.rangeLen = pendingRange.rangeLen
+				if pendingRange.rangeOff >= 0 {
+					seg.rangeOff = pendingRange.rangeOff
+				} else {
+					seg.rangeOff = lastEndByURL[resolved]
+				}
+				lastEndByURL[resolved] = seg.rangeOff + seg.rangeLen
+				pendingRange = nil
+			}
+			segments = append(segments, seg)
+		}
+	}
+	return segments, scanner.Err()
+}
+
+// parseHLSAttrInt extracts an integer-valued attribute (e.g. BANDWIDTH=1234567) from an HLS
+// tag line.
+func parseHLSAttrInt(line, attr string) int {
+	idx := strings.Index(line, attr+"=")
+	if idx < 0 {
+		return 0
+	}
+	rest := line[idx+len(attr)+1:]
+	end := strings.IndexAny(rest, ",\"")
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(rest))
+	return n
+}
+
+// parseHLSByteRange parses an #EXT-X-BYTERANGE value: "<length>" or "<length>@<offset>".
+func parseHLSByteRange(value string) (length, offset int64, hasOffset bool) {
+	parts := strings.SplitN(value, "@", 2)
+	length, _ = strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if len(parts) == 2 {
+		offset, _ = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		hasOffset = true
+	}
+	return length, offset, hasOffset
+}
+
+// resolveHLSURL resolves a (possibly relative) playlist/segment URI against the playlist it
+// was listed in.
+func resolveHLSURL(baseURL, ref string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse playlist URL: %w", err)
+	}
+	rel, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse playlist reference %q: %w", ref, err)
+	}
+	return base.ResolveReference(rel).String(), nil
+}
+
+// fetchHLSSegments downloads every segment across mf.maxConcurrent workers and returns their
+// bytes in playlist order, so the caller can concatenate them into a single file.
+func (mf *MediaFetcher) fetchHLSSegments(ctx context.Context, segments []hlsSegment) ([][]byte, error) {
+	workers := mf.maxConcurrent
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+
+	type segResult struct {
+		idx  int
+		data []byte
+		err  error
+	}
+
+	indexCh := make(chan int)
+	results := make(chan segResult)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range indexCh {
+				data, err := mf.fetchHLSSegment(ctx, segments[idx])
+				results <- segResult{idx: idx, data: data, err: err}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(indexCh)
+		for i := range segments {
+			select {
+			case <-ctx.Done():
+				// Everything from here on was never handed to a worker - report each as
+				// failed rather than leaving its slot in data nil and silently returning success.
+				for j := i; j < len(segments); j++ {
+					results <- segResult{idx: j, err: ctx.Err()}
+				}
+				return
+			case indexCh <- i:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	data := make([][]byte, len(segments))
+	var firstErr error
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		data[res.idx] = res.data
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return data, nil
+}
+
+// fetchHLSSegment downloads one segment, issuing a Range request when the playlist specified
+// one via #EXT-X-BYTERANGE, and verifies the downloaded length matches it.
+func (mf *MediaFetcher) fetchHLSSegment(ctx context.Context, seg hlsSegment) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seg.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if seg.hasRange {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.rangeOff, seg.rangeOff+seg.rangeLen-1))
+	}
+
+	resp, err := mf.doRequestWithRetry(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch segment %s: %w", seg.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("segment %s returned %s", seg.url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment %s: %w", seg.url, err)
+	}
+	if seg.hasRange && int64(len(data)) != seg.rangeLen {
+		return nil, fmt.Errorf("segment %s: got %d bytes, expected %d", seg.url, len(data), seg.rangeLen)
+	}
+	return data, nil
+}
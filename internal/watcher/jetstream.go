@@ -0,0 +1,194 @@
+// Package watcher subscribes to a Jetstream (AT Protocol firehose) feed and invokes a
+// callback for each "app.bsky.feed.like" commit created by a given actor. It exists as its
+// own package because the decoder, cursor persistence, and reconnect/backoff loop are a
+// substantial subsystem in their own right, separate from LikeLocker's download logic.
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultURL is Bluesky's public Jetstream endpoint, used when FIREHOSE_URL isn't set.
+const DefaultURL = "wss://jetstream2.us-east.bsky.network/subscribe"
+
+// likeCollection is the only collection this watcher subscribes to - it only cares about the
+// configured actor's own likes, not every commit on the firehose.
+const likeCollection = "app.bsky.feed.like"
+
+// OnLike is called with the URI of a post the watched actor just liked. Returning an error
+// only logs a warning; it doesn't stop the watcher or block the cursor from advancing, since a
+// single bad post shouldn't wedge the subscription.
+type OnLike func(ctx context.Context, postURI string) error
+
+// Watcher maintains a reconnecting Jetstream subscription filtered to one actor's likes.
+type Watcher struct {
+	url        string
+	actorDID   string
+	cursorFile string
+	onLike     OnLike
+}
+
+// New builds a Watcher. jetstreamURL defaults to DefaultURL if empty.
+func New(jetstreamURL, actorDID, cursorFile string, onLike OnLike) *Watcher {
+	if jetstreamURL == "" {
+		jetstreamURL = DefaultURL
+	}
+	return &Watcher{url: jetstreamURL, actorDID: actorDID, cursorFile: cursorFile, onLike: onLike}
+}
+
+// Run connects to Jetstream and processes like commits until ctx is cancelled, reconnecting
+// with exponential backoff on any read/dial error. It resumes from the last persisted cursor
+// on every (re)connect, including the first, so a process restart doesn't replay history.
+func (w *Watcher) Run(ctx context.Context) error {
+	backoff := time.Second
+	const maxBackoff = time.Minute
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := w.runOnce(ctx)
+		if err == nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		fmt.Printf("Jetstream connection lost, reconnecting in %s: %v\n", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runOnce holds a single Jetstream connection open until it errors or ctx is cancelled.
+func (w *Watcher) runOnce(ctx context.Context) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, w.dialURL(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to dial jetstream: %w", err)
+	}
+	defer conn.Close()
+
+	fmt.Printf("Connected to jetstream, watching likes by %s\n", w.actorDID)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read jetstream message: %w", err)
+		}
+
+		var event jetstreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			fmt.Printf("Warning: failed to decode jetstream event: %v\n", err)
+			continue
+		}
+		w.handleEvent(ctx, event)
+
+		if err := saveCursor(w.cursorFile, event.TimeUS); err != nil {
+			fmt.Printf("Warning: failed to persist jetstream cursor: %v\n", err)
+		}
+	}
+}
+
+// dialURL adds the wantedCollections/wantedDids filters and the resume cursor (if any) to the
+// configured Jetstream URL.
+func (w *Watcher) dialURL() string {
+	u, err := url.Parse(w.url)
+	if err != nil {
+		// Fall back to the raw URL - DialContext will surface the same parse error.
+		return w.url
+	}
+	q := u.Query()
+	q.Set("wantedCollections", likeCollection)
+	if w.actorDID != "" {
+		q.Set("wantedDids", w.actorDID)
+	}
+	if cursor, err := loadCursor(w.cursorFile); err == nil && cursor > 0 {
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// handleEvent invokes onLike for a create-operation like commit, ignoring everything else
+// (deletes, other collections, which shouldn't arrive given wantedCollections but are cheap to
+// filter out defensively).
+func (w *Watcher) handleEvent(ctx context.Context, event jetstreamEvent) {
+	if event.Kind != "commit" || event.Commit == nil {
+		return
+	}
+	commit := event.Commit
+	if commit.Collection != likeCollection || commit.Operation != "create" || commit.Record == nil {
+		return
+	}
+	if commit.Record.Subject.Uri == "" {
+		return
+	}
+	if err := w.onLike(ctx, commit.Record.Subject.Uri); err != nil {
+		fmt.Printf("Warning: failed to handle like for %s: %v\n", commit.Record.Subject.Uri, err)
+	}
+}
+
+// jetstreamEvent is the subset of Jetstream's JSON event schema this watcher cares about.
+type jetstreamEvent struct {
+	Kind   string           `json:"kind"`
+	TimeUS int64            `json:"time_us"`
+	Commit *jetstreamCommit `json:"commit,omitempty"`
+}
+
+type jetstreamCommit struct {
+	Operation  string         `json:"operation"`
+	Collection string         `json:"collection"`
+	Record     *jetstreamLike `json:"record,omitempty"`
+}
+
+type jetstreamLike struct {
+	Subject struct {
+		Uri string `json:"uri"`
+		Cid string `json:"cid"`
+	} `json:"subject"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// loadCursor reads the persisted Jetstream time_us cursor, if any.
+func loadCursor(path string) (int64, error) {
+	if path == "" {
+		return 0, fmt.Errorf("no cursor file configured")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// saveCursor persists the Jetstream time_us cursor so a restart resumes from here instead of
+// replaying history.
+func saveCursor(path string, cursor int64) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strconv.FormatInt(cursor, 10)), 0644)
+}
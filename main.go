@@ -1,33 +1,44 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/JackmanAlex228/LikeLocker/internal/storage"
+	"github.com/JackmanAlex228/LikeLocker/internal/watcher"
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/joho/godotenv"
+	"golang.org/x/time/rate"
 )
 
 type MediaFetcher struct {
 	client          *xrpc.Client
-	downloadDir     string          // Where files are saved (external drive)
-	cacheFile       string          // Local cache file tracking downloads
-	downloadedFiles map[string]bool // In-memory cache
+	downloadDir     string                // Where files are saved (external drive)
+	cacheFile       string                // Legacy flat cache file, migrated into the store on first run
+	dbPath          string                // sqlite metadata store path
+	store           Store                 // Persists CacheEntry rows
+	storage         storage.Backend       // Where downloaded bytes actually land (local disk, S3, WebDAV)
+	downloadedFiles map[string]CacheEntry // In-memory cache, keyed by filename
+	cacheMu         sync.Mutex
+	maxConcurrent   int   // Size of the download worker pool
+	useFFmpeg       bool  // Fall back to shelling out to ffmpeg instead of the in-process HLS downloader
+	writeSidecar    bool  // Write a <filename>.json sidecar with post/author metadata alongside each download
+	maxCacheBytes   int64 // Rolling-cache cap enforced by evictLRU after each download; 0 means unbounded ("permanent archive" mode)
+	pinnedMu        sync.Mutex
+	pinned          map[string]bool // Filenames currently being written, excluded from eviction
+	perHostRate     float64         // Per-host request rate limit (req/sec), PER_HOST_RATE_LIMIT
+	hostLimitersMu  sync.Mutex
+	hostLimiters    map[string]*rate.Limiter // Lazily created per-host, shared across workers
 }
 
 // notify sends a push notification via ntfy.sh (if topic is configured)
@@ -43,12 +54,18 @@ func notify(topic, message string) {
 	resp.Body.Close()
 }
 
-// NewMediaFetcher(handle, password, downloadDir, cacheFile string) : MediaFetcher!
-func NewMediaFetcher(handle, password, downloadDir, cacheFile string) (*MediaFetcher, error) {
-	// Create download directory
+// NewMediaFetcher(handle, password, downloadDir, cacheFile, dbPath, storageBackend string, maxConcurrent int, useFFmpeg, writeSidecar bool, maxCacheBytes int64, perHostRate float64) : MediaFetcher!
+func NewMediaFetcher(handle, password, downloadDir, cacheFile, dbPath, storageBackend string, maxConcurrent int, useFFmpeg, writeSidecar bool, maxCacheBytes int64, perHostRate float64) (*MediaFetcher, error) {
+	// Create download directory (also used as local scratch space for in-flight downloads
+	// regardless of which Storage backend is configured)
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create download dir: %w", err)
 	}
+
+	backend, err := storage.New(storageBackend, downloadDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
 	// 	Create XRPC client
 	client := &xrpc.Client{
 		Host: "https://bsky.social",
@@ -71,11 +88,23 @@ func NewMediaFetcher(handle, password, downloadDir, cacheFile string) (*MediaFet
 		Handle:     auth.Handle,
 		Did:        auth.Did,
 	}
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
 	mf := &MediaFetcher{
 		client:          client,
 		downloadDir:     downloadDir,
 		cacheFile:       cacheFile,
-		downloadedFiles: make(map[string]bool),
+		dbPath:          dbPath,
+		storage:         backend,
+		downloadedFiles: make(map[string]CacheEntry),
+		maxConcurrent:   maxConcurrent,
+		useFFmpeg:       useFFmpeg,
+		writeSidecar:    writeSidecar,
+		maxCacheBytes:   maxCacheBytes,
+		pinned:          make(map[string]bool),
+		perHostRate:     perHostRate,
+		hostLimiters:    make(map[string]*rate.Limiter),
 	}
 
 	// Load cache from file
@@ -91,15 +120,22 @@ func NewMediaFetcher(handle, password, downloadDir, cacheFile string) (*MediaFet
 	return mf, nil
 }
 
-// FetchAndDownload fetches liked posts and downloads media in batches, stopping when downloadLimit is reached
+// FetchAndDownload fetches liked posts and downloads their media, fanning jobs out across a
+// worker pool (mf.maxConcurrent goroutines) and stopping once downloadLimit is reached. Each
+// batch queues at most as many jobs as downloads remain under downloadLimit, so the pool never
+// starts more downloads than the limit allows. The ctx passed to each job is not cancelled
+// when the limit is hit; it is cancelled only when FetchAndDownload returns.
 func (mf *MediaFetcher) FetchAndDownload(actor string, batchSize int64, downloadLimit int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	var cursor string
 	downloadCount := 0
 	postsProcessed := 0
 
 	fmt.Print("\033[s")
 	for downloadCount < downloadLimit {
-		resp, err := bsky.FeedGetActorLikes(context.Background(), mf.client, actor, cursor, batchSize)
+		resp, err := bsky.FeedGetActorLikes(ctx, mf.client, actor, cursor, batchSize)
 		if err != nil {
 			return fmt.Errorf("failed to fetch likes: %w", err)
 		}
@@ -109,62 +145,30 @@ func (mf *MediaFetcher) FetchAndDownload(actor string, batchSize int64, download
 			break
 		}
 
-		// Process and download from this batch
+		// Collect every job in this batch so downloads across posts run concurrently,
+		// rather than serializing on a per-post basis.
+		var jobs []downloadJob
 		for _, post := range resp.Feed {
-			if downloadCount >= downloadLimit {
-				fmt.Printf("\nReached download limit of %d files\n", downloadLimit)
-				fmt.Printf("Total files downloaded: %d\n", downloadCount)
-				return nil
-			}
-
 			postsProcessed++
-			fmt.Print("\033[u\033[K")
-			fmt.Printf("Processing post %d (downloaded: %d/%d)\n", postsProcessed, downloadCount, downloadLimit)
-
-			// Check if post has embed
-			if post.Post.Embed == nil {
-				continue
+			remaining := downloadLimit - downloadCount - len(jobs)
+			if remaining <= 0 {
+				break
 			}
+			jobs = append(jobs, jobsForEmbed(post.Post.Embed, remaining, postMetaFor(post.Post))...)
+		}
 
-			embed := post.Post.Embed
-
-			// Handle different embed types by checking which field is populated
-			if embed.EmbedImages_View != nil {
-				downloaded, err := mf.downloadImages(embed.EmbedImages_View.Images, downloadLimit-downloadCount)
-				downloadCount += downloaded
-				if err != nil {
-					fmt.Printf("Error downloading images: %v\n", err)
-				}
-			}
+		fmt.Print("\033[u\033[K")
+		fmt.Printf("Processing post %d (downloaded: %d/%d, queued: %d)\n", postsProcessed, downloadCount, downloadLimit, len(jobs))
 
-			if embed.EmbedVideo_View != nil && downloadCount < downloadLimit {
-				downloaded, err := mf.downloadVideo(embed.EmbedVideo_View)
-				downloadCount += downloaded
-				if err != nil {
-					fmt.Printf("Error downloading video: %v\n", err)
-				}
-			}
+		downloaded, err := mf.runDownloadJobs(ctx, jobs)
+		downloadCount += downloaded
+		if err != nil {
+			fmt.Printf("Error downloading media: %v\n", err)
+		}
 
-			if embed.EmbedRecordWithMedia_View != nil && downloadCount < downloadLimit {
-				// Handle posts with both record and media
-				if embed.EmbedRecordWithMedia_View.Media != nil {
-					media := embed.EmbedRecordWithMedia_View.Media
-					if media.EmbedImages_View != nil {
-						downloaded, err := mf.downloadImages(media.EmbedImages_View.Images, downloadLimit-downloadCount)
-						downloadCount += downloaded
-						if err != nil {
-							fmt.Printf("Error downloading images: %v\n", err)
-						}
-					}
-					if media.EmbedVideo_View != nil && downloadCount < downloadLimit {
-						downloaded, err := mf.downloadVideo(media.EmbedVideo_View)
-						downloadCount += downloaded
-						if err != nil {
-							fmt.Printf("Error downloading video: %v\n", err)
-						}
-					}
-				}
-			}
+		if downloadCount >= downloadLimit {
+			fmt.Printf("\nReached download limit of %d files\n", downloadLimit)
+			break
 		}
 
 		// Break if no more pages
@@ -209,7 +213,7 @@ func (mf *MediaFetcher) WatchLikes(actor string, interval time.Duration, ntfyTop
 			seen[post.Post.Uri] = true
 			fmt.Printf("New like: %s\n", post.Post.Uri)
 
-			downloaded, err := mf.downloadPostMedia(post.Post.Embed)
+			downloaded, err := mf.downloadPostMedia(post.Post)
 			if err != nil {
 				fmt.Printf("Error downloading media: %v\n", err)
 			} else if downloaded > 0 {
@@ -220,251 +224,17 @@ func (mf *MediaFetcher) WatchLikes(actor string, interval time.Duration, ntfyTop
 	}
 }
 
-// loadCache reads the cache file and populates the downloadedFiles map
-func (mf *MediaFetcher) loadCache() error {
-	file, err := os.Open(mf.cacheFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("No cache file found, starting fresh")
-			return nil
-		}
-		return err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	count := 0
-	for scanner.Scan() {
-		filename := strings.TrimSpace(scanner.Text())
-		if filename != "" {
-			mf.downloadedFiles[filename] = true
-			count++
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-
-	fmt.Printf("Cached %d files already downloaded\n", count)
-	return nil
-}
-
-// saveCache writes the current cache to disk
-func (mf *MediaFetcher) saveCache() error {
-	file, err := os.Create(mf.cacheFile)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-	for filename := range mf.downloadedFiles {
-		if _, err := writer.WriteString(filename + "\n"); err != nil {
-			return err
-		}
-	}
-
-	return writer.Flush()
-}
-
-// syncCacheFromDirectory scans the download directory and adds any existing files to the cache.
-// Useful for recovering from a lost/corrupted cache file or when files were added manually.
-func (mf *MediaFetcher) syncCacheFromDirectory() error {
-	entries, err := os.ReadDir(mf.downloadDir)
-	if err != nil {
-		return fmt.Errorf("failed to read download directory: %w", err)
-	}
-
-	added := 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		filename := entry.Name()
-		if !mf.downloadedFiles[filename] {
-			mf.downloadedFiles[filename] = true
-			added++
-		}
-	}
-	if added > 0 {
-		fmt.Printf("Synced %d files from directory to cache\n", added)
-		if err := mf.saveCache(); err != nil {
-			return fmt.Errorf("failed to save cache after sync: %w", err)
-		}
-	}
-	return nil
-}
-
-// markDownloaded adds a filename to the cache and saves it
-func (mf *MediaFetcher) markDownloaded(filename string) error {
-	mf.downloadedFiles[filename] = true
-	return mf.saveCache()
-}
-
-// isDownloaded checks if a file has already been downloaded
-func (mf *MediaFetcher) isDownloaded(filename string) bool {
-	return mf.downloadedFiles[filename]
-}
-
-// downloadPostMedia downloads any media from a single post's embed
-func (mf *MediaFetcher) downloadPostMedia(embed *bsky.FeedDefs_PostView_Embed) (int, error) {
-	if embed == nil {
-		return 0, nil
-	}
-
-	downloaded := 0
-
-	if embed.EmbedImages_View != nil {
-		n, err := mf.downloadImages(embed.EmbedImages_View.Images, len(embed.EmbedImages_View.Images))
-		downloaded += n
-		if err != nil {
-			return downloaded, err
-		}
-	}
-
-	if embed.EmbedVideo_View != nil {
-		n, err := mf.downloadVideo(embed.EmbedVideo_View)
-		downloaded += n
-		if err != nil {
-			return downloaded, err
-		}
-	}
-
-	if embed.EmbedRecordWithMedia_View != nil && embed.EmbedRecordWithMedia_View.Media != nil {
-		media := embed.EmbedRecordWithMedia_View.Media
-		if media.EmbedImages_View != nil {
-			n, err := mf.downloadImages(media.EmbedImages_View.Images, len(media.EmbedImages_View.Images))
-			downloaded += n
-			if err != nil {
-				return downloaded, err
-			}
-		}
-		if media.EmbedVideo_View != nil {
-			n, err := mf.downloadVideo(media.EmbedVideo_View)
-			downloaded += n
-			if err != nil {
-				return downloaded, err
-			}
-		}
-	}
-
-	return downloaded, nil
-}
-
-// MediaFetcher : downloadImages(images []bsky.FeedDefs_FeedViewPost, limit int) : (int, error)
-func (mf *MediaFetcher) downloadImages(images []*bsky.EmbedImages_ViewImage, limit int) (int, error) {
-	downloadCount := 0
-	for _, img := range images {
-		if downloadCount >= limit {
-			break
-		}
-		downloaded, err := mf.downloadFile(img.Fullsize, "image")
-		if err != nil {
-			return downloadCount, err
-		}
-		downloadCount += downloaded
-	}
-	return downloadCount, nil
-}
-
-// MediaFetcher : downloadVideo(video bsky.EmbedVideo_View) : (int, error)
-// Uses ffmpeg to download HLS stream and convert to mp4
-func (mf *MediaFetcher) downloadVideo(video *bsky.EmbedVideo_View) (int, error) {
-	if video.Playlist == "" {
-		return 0, nil
-	}
-
-	// Generate filename from URL hash
-	hash := sha256.Sum256([]byte(video.Playlist))
-	cacheKey := hex.EncodeToString(hash[:])
-	filename := cacheKey + ".mp4"
-	outputPath := filepath.Join(mf.downloadDir, filename)
-
-	// Check if already downloaded
-	if mf.isDownloaded(filename) {
-		fmt.Printf("Cache hit: %s\n", filename)
-		return 0, nil
-	}
-
-	fmt.Printf("Downloading video via ffmpeg: %s\n", video.Playlist)
-
-	// Use ffmpeg to download and convert HLS stream to mp4
-	cmd := exec.Command("ffmpeg", "-i", video.Playlist, "-c", "copy", "-y", outputPath)
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-
-	if err := cmd.Run(); err != nil {
-		return 0, fmt.Errorf("ffmpeg failed: %w", err)
-	}
-
-	// Mark as downloaded in cache
-	if err := mf.markDownloaded(filename); err != nil {
-		fmt.Printf("Warning: failed to update cache: %v\n", err)
-	}
-
-	fmt.Printf("Saved: %s\n", filename)
-	return 1, nil
-}
-
-// MediaFetcher : downloadFile(url, mediaType string) : (int, error)
-func (mf *MediaFetcher) downloadFile(url, mediaType string) (int, error) {
-	//	Generate cache key from URL
-	hash := sha256.Sum256([]byte(url))
-	cacheKey := hex.EncodeToString(hash[:])
-	//	Determine file extension
-	ext := filepath.Ext(url)
-	if ext == "" {
-		if strings.Contains(url, "m3u8") {
-			ext = ".m3u8"
-		} else if mediaType == "image" {
-			ext = ".png"
-		} else {
-			ext = ".mp4"
-		}
-	}
-	filename := cacheKey + ext
-	filepath := filepath.Join(mf.downloadDir, filename)
-	//	Check if already cached
-	if mf.isDownloaded(filename) {
-		fmt.Printf("Cache hit: %s\n", filename)
-		return 0, nil // Return 0 because we didn't download a new file
-	}
-	fmt.Printf("Downloading: %s\n", url)
-	//	Download file
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, fmt.Errorf("failed to download: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("bad status: %s", resp.Status)
-	}
-	//	Create file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create file: %w", err)
-	}
-	defer out.Close()
-	//	Write to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return 0, fmt.Errorf("failed to write file: %w", err)
-	}
-
-	// Mark as downloaded in cache
-	if err := mf.markDownloaded(filename); err != nil {
-		fmt.Printf("Warning: failed to update cache: %v\n", err)
-	}
-
-	fmt.Printf("Saved: %s\n", filename)
-	return 1, nil // Return 1 because we successfully downloaded a new file
-}
-
 // main()
 func main() {
 	// Parse command-line flags
 	watchOnlyFlag := flag.Bool("watch", false, "Skip initial download, only watch for new likes")
+	pruneFlag := flag.Bool("prune", false, "Remove downloaded media that's no longer liked (or too old), then exit")
+	pruneOlderThanDays := flag.Int("older-than-days", 0, "With -prune, also remove files downloaded more than this many days ago (0 disables the age check)")
+	modeFlag := flag.String("mode", "poll", "Watch mode: \"poll\" (FeedGetActorLikes on an interval) or \"firehose\" (Jetstream subscription)")
+	dbInfoFlag := flag.Bool("dbinfo", false, "Print counts by author and media type, and total bytes, then exit")
+	dbInfoJSONFlag := flag.Bool("dbinfo-json", false, "With -dbinfo, dump the full metadata store as a JSON manifest instead of a summary")
+	extractURIFlag := flag.String("extract", "", "Re-emit cached media for the given post URI, then exit")
+	extractDirFlag := flag.String("extract-dir", ".", "With -extract, directory to write the extracted media into")
 	flag.Parse()
 
 	// Load environment variables from .env file (optional - Docker passes env vars directly)
@@ -475,9 +245,20 @@ func main() {
 	password := os.Getenv("BSKY_PASSWORD")
 	downloadDir := os.Getenv("DOWNLOAD_DIR")
 	cacheFile := os.Getenv("CACHE_FILE")
+	dbFile := os.Getenv("DB_FILE")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
 	downloadLimitStr := os.Getenv("DOWNLOAD_LIMIT")
 	pollIntervalMinutes := os.Getenv("POLL_INTERVAL_MINUTES")
 	watchOnlyEnv := os.Getenv("WATCH_ONLY")
+	maxConcurrent := maxConcurrentDownloadsFromEnv(os.Getenv("MAX_CONCURRENT_DOWNLOADS"))
+	useFFmpeg := os.Getenv("USE_FFMPEG") == "1"
+	writeSidecar := os.Getenv("WRITE_SIDECAR") == "true"
+	maxCacheBytes := maxCacheBytesFromEnv(os.Getenv("MAX_CACHE_BYTES"))
+	perHostRate := perHostRateLimitFromEnv(os.Getenv("PER_HOST_RATE_LIMIT"))
+	firehoseURL := os.Getenv("FIREHOSE_URL")
+	if firehoseURL == "" {
+		firehoseURL = watcher.DefaultURL
+	}
 
 	// Watch only mode: true if --watch flag OR WATCH_ONLY=true
 	watchOnly := *watchOnlyFlag || watchOnlyEnv == "true"
@@ -494,6 +275,9 @@ func main() {
 	if cacheFile == "" {
 		cacheFile = "./downloaded_cache.txt"
 	}
+	if dbFile == "" {
+		dbFile = "./downloaded_cache.db"
+	}
 	if downloadLimitStr == "" {
 		downloadLimitStr = "100"
 	}
@@ -514,12 +298,41 @@ func main() {
 	}
 
 	//	Create fetcher
-	fetcher, err2 := NewMediaFetcher(handle, password, downloadDir, cacheFile)
+	fetcher, err2 := NewMediaFetcher(handle, password, downloadDir, cacheFile, dbFile, storageBackend, maxConcurrent, useFFmpeg, writeSidecar, maxCacheBytes, perHostRate)
 	if err2 != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing: %v\n", err2)
 		os.Exit(1)
 	}
 
+	// Prune mode: remove stale/unliked media and exit, without starting the fetch/watch loop.
+	if *pruneFlag {
+		if _, err := fetcher.Prune(context.Background(), handle, *pruneOlderThanDays); err != nil {
+			fmt.Fprintf(os.Stderr, "Error pruning: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// DB info mode: print (or dump) the metadata store and exit.
+	if *dbInfoFlag {
+		if err := fetcher.DBInfo(*dbInfoJSONFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading db info: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Extract mode: re-emit cached media for a single post URI and exit.
+	if *extractURIFlag != "" {
+		n, err := fetcher.Extract(context.Background(), *extractURIFlag, *extractDirFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error extracting: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Extracted %d file(s)\n", n)
+		return
+	}
+
 	// Get ntfy topic for notifications
 	ntfyTopic := os.Getenv("NTFY_TOPIC")
 	if ntfyTopic != "" {
@@ -551,9 +364,19 @@ func main() {
 		}
 	}
 
-	// Watch mode - poll every X seconds
-	if err := fetcher.WatchLikes(handle, time.Duration(pollIntervalMin)*time.Minute, ntfyTopic); err != nil {
-		log.Fatal(err)
+	// Watch mode - either poll on an interval or subscribe to the Jetstream firehose.
+	switch *modeFlag {
+	case "firehose":
+		cursorFile := cacheFile + ".firehose-cursor"
+		if err := fetcher.WatchFirehose(context.Background(), firehoseURL, cursorFile, ntfyTopic); err != nil {
+			log.Fatal(err)
+		}
+	case "poll":
+		if err := fetcher.WatchLikes(handle, time.Duration(pollIntervalMin)*time.Minute, ntfyTopic); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Invalid -mode %q: must be \"poll\" or \"firehose\"", *modeFlag)
 	}
 
 	fmt.Println("Done!")
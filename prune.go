@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Prune removes downloaded media whose originating post is no longer liked, or whose
+// download predates olderThanDays (0 disables the age check). It only considers entries with
+// a known PostURI for the "no longer liked" check, since files synced from the download
+// directory by syncCacheFromDirectory (or migrated from the legacy cache) never had one -
+// pruning those based on absence from the current likes would delete files we have no real
+// evidence were unliked.
+//
+// Deleting an entry here doesn't redownload anything: if the same media is encountered again
+// in a later FetchAndDownload/WatchLikes pass, isDownloaded will report it missing and the
+// normal download path fetches it fresh.
+func (mf *MediaFetcher) Prune(ctx context.Context, actor string, olderThanDays int) (int, error) {
+	liked, err := mf.fetchLikedPostURIs(ctx, actor)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch current likes: %w", err)
+	}
+
+	var cutoff time.Time
+	if olderThanDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -olderThanDays)
+	}
+
+	mf.cacheMu.Lock()
+	entries := make([]CacheEntry, 0, len(mf.downloadedFiles))
+	for _, entry := range mf.downloadedFiles {
+		entries = append(entries, entry)
+	}
+	mf.cacheMu.Unlock()
+
+	pruned := 0
+	for _, entry := range entries {
+		reason := ""
+		if entry.PostURI != "" && !liked[entry.PostURI] {
+			reason = "post no longer liked"
+		} else if !cutoff.IsZero() && entry.DownloadedAt != "" {
+			downloadedAt, err := time.Parse(time.RFC3339, entry.DownloadedAt)
+			if err == nil && downloadedAt.Before(cutoff) {
+				reason = fmt.Sprintf("downloaded more than %d days ago", olderThanDays)
+			}
+		}
+		if reason == "" {
+			continue
+		}
+
+		if err := mf.storage.Delete(ctx, entry.Filename); err != nil {
+			fmt.Printf("Warning: failed to delete %s from storage: %v\n", entry.Filename, err)
+			continue
+		}
+		if err := mf.unmarkDownloaded(entry.Filename); err != nil {
+			fmt.Printf("Warning: failed to remove %s from cache: %v\n", entry.Filename, err)
+			continue
+		}
+		fmt.Printf("Pruned %s (%s)\n", entry.Filename, reason)
+		pruned++
+	}
+
+	fmt.Printf("Prune complete: removed %d file(s)\n", pruned)
+	return pruned, nil
+}
+
+// fetchLikedPostURIs pages through the actor's current likes and returns their post URIs, so
+// Prune can tell which cached entries' posts have since been unliked.
+func (mf *MediaFetcher) fetchLikedPostURIs(ctx context.Context, actor string) (map[string]bool, error) {
+	liked := make(map[string]bool)
+	var cursor string
+	for {
+		resp, err := bsky.FeedGetActorLikes(ctx, mf.client, actor, cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range resp.Feed {
+			liked[post.Post.Uri] = true
+		}
+		if resp.Cursor == nil || *resp.Cursor == "" || len(resp.Feed) == 0 {
+			break
+		}
+		cursor = *resp.Cursor
+	}
+	return liked, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxHTTPRetries bounds doRequestWithRetry's backoff loop for 429/5xx responses.
+const maxHTTPRetries = 4
+
+// perHostRateLimitFromEnv parses PER_HOST_RATE_LIMIT (requests/sec per host), defaulting to 5.
+func perHostRateLimitFromEnv(raw string) float64 {
+	if raw == "" {
+		return 5
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil || n <= 0 {
+		return 5
+	}
+	return n
+}
+
+// limiterFor returns the rate.Limiter for req's host, creating one (burst 1, so a host that's
+// gone quiet for a while can't burst past its steady-state rate) on first use. Every worker
+// downloading from the same CDN host shares this limiter, so concurrency across many distinct
+// CDNs stays high while any single host is throttled politely.
+func (mf *MediaFetcher) limiterFor(host string) *rate.Limiter {
+	mf.hostLimitersMu.Lock()
+	defer mf.hostLimitersMu.Unlock()
+	if mf.hostLimiters == nil {
+		mf.hostLimiters = make(map[string]*rate.Limiter)
+	}
+	l, ok := mf.hostLimiters[host]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(mf.perHostRate), 1)
+		mf.hostLimiters[host] = l
+	}
+	return l
+}
+
+// doRequestWithRetry waits for a per-host rate-limit token, then issues req, retrying with
+// exponential backoff + jitter on 429 (honoring Retry-After if present) and 5xx responses.
+// Network errors aren't retried here - downloadFile's own attempt loop already covers those by
+// restarting the whole resumable download. HLS playlist and segment fetches have no such outer
+// loop, so a network error there fails the video download.
+func (mf *MediaFetcher) doRequestWithRetry(ctx context.Context, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		if err := mf.limiterFor(host).Wait(ctx); err != nil {
+			return nil, fmt.Errorf("rate limit wait cancelled: %w", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt == maxHTTPRetries {
+			return resp, nil
+		}
+
+		wait := backoff
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if ra := retryAfterDuration(resp.Header.Get("Retry-After")); ra > 0 {
+				wait = ra
+			}
+		}
+		resp.Body.Close()
+
+		// Jitter of up to 100% of the wait: spreads out retries from many workers hitting the same host so they
+		// don't all wake up and retry in lockstep.
+		wait += time.Duration(rand.Int63n(int64(wait) + 1))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// retryAfterDuration parses a Retry-After header, which may be either a number of seconds or
+// an HTTP date. Returns 0 if raw is empty or unparseable, signaling "use the default backoff".
+func retryAfterDuration(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// SidecarMetadata is everything FetchAndDownload/WatchLikes already has in hand about a liked
+// post's media, captured so the downloaded corpus can be used for things like dataset/search
+// tooling without re-scraping the API. Written as "<filename>.json" next to the media itself
+// when WRITE_SIDECAR=true.
+type SidecarMetadata struct {
+	Filename          string `json:"filename"`
+	URL               string `json:"url"`
+	CID               string `json:"cid,omitempty"`
+	PostCID           string `json:"post_cid,omitempty"`
+	PostURI           string `json:"post_uri,omitempty"`
+	AuthorDID         string `json:"author_did,omitempty"`
+	AuthorHandle      string `json:"author_handle,omitempty"`
+	PostText          string `json:"post_text,omitempty"`
+	CreatedAt         string `json:"created_at,omitempty"`
+	LikedAt           string `json:"liked_at,omitempty"`
+	AltText           string `json:"alt_text,omitempty"`
+	AspectRatioWidth  int64  `json:"aspect_ratio_width,omitempty"`
+	AspectRatioHeight int64  `json:"aspect_ratio_height,omitempty"`
+}
+
+// sidecarFor builds the SidecarMetadata for a downloadJob's media now that it's been saved
+// under filename with the given CID (if any).
+func sidecarFor(job downloadJob, filename, url, cid string) SidecarMetadata {
+	return SidecarMetadata{
+		Filename:          filename,
+		URL:               url,
+		CID:               cid,
+		PostCID:           job.postMeta.postCID,
+		PostURI:           job.postMeta.postURI,
+		AuthorDID:         job.postMeta.authorDID,
+		AuthorHandle:      job.postMeta.authorHandle,
+		PostText:          job.postMeta.postText,
+		CreatedAt:         job.postMeta.createdAt,
+		LikedAt:           job.postMeta.likedAt,
+		AltText:           job.altText,
+		AspectRatioWidth:  job.aspectW,
+		AspectRatioHeight: job.aspectH,
+	}
+}
+
+// maybeWriteSidecar marshals meta and writes it to "<meta.Filename>.json" via the configured
+// Storage backend. A no-op unless WRITE_SIDECAR=true. Called right alongside markDownloaded at
+// every download call site, best-effort: its caller only logs a warning on failure, so a
+// transient Storage error can leave a cache entry with no corresponding sidecar.
+func (mf *MediaFetcher) maybeWriteSidecar(ctx context.Context, meta SidecarMetadata) error {
+	if !mf.writeSidecar {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sidecar metadata: %w", err)
+	}
+
+	key := meta.Filename + ".json"
+	if err := mf.storage.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write sidecar %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite" // pure-Go sqlite driver, no cgo required
+)
+
+// Store persists one row per downloaded media item. It replaces the original newline-
+// delimited cache file so downloads can be queried (by author, media type, CID, ...) instead
+// of just checked for presence.
+type Store interface {
+	// All returns every known CacheEntry, keyed by filename, for populating the in-memory
+	// cache on startup.
+	All() (map[string]CacheEntry, error)
+	// Save upserts a single entry.
+	Save(entry CacheEntry) error
+	// Delete removes a single entry by filename.
+	Delete(filename string) error
+	// Close releases the underlying connection.
+	Close() error
+}
+
+// sqliteStore is the default Store, backed by modernc.org/sqlite (cgo-free).
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (creating if necessary) a sqlite database at path and ensures the
+// downloads table exists.
+func NewSQLiteStore(path string) (*sqliteStore, error) {
+	// journal_mode=WAL lets readers proceed while a write is in progress, and busy_timeout
+	// makes SQLITE_BUSY retry internally instead of surfacing immediately - both needed because
+	// mf.maxConcurrent workers call Save/All concurrently from runDownloadJobs.
+	dsn := path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite store: %w", err)
+	}
+	// modernc.org/sqlite has no real concurrent-writer support; serialize all access through a
+	// single connection so writers queue behind the busy timeout above instead of racing a
+	// second connection straight into SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to sqlite store: %w", err)
+	}
+
+	const schema = `
+	CREATE TABLE IF NOT EXISTS downloads (
+		filename      TEXT PRIMARY KEY,
+		url           TEXT NOT NULL,
+		etag          TEXT,
+		last_modified TEXT,
+		size          INTEGER,
+		cid           TEXT,
+		post_cid      TEXT,
+		post_uri      TEXT,
+		author_did    TEXT,
+		author_handle TEXT,
+		alt_text      TEXT,
+		liked_at      TEXT,
+		mime_type     TEXT,
+		downloaded_at TEXT,
+		last_accessed TEXT
+	);`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create downloads table: %w", err)
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) All() (map[string]CacheEntry, error) {
+	rows, err := s.db.Query(`SELECT filename, url, etag, last_modified, size, cid, post_cid, post_uri, author_did, author_handle, alt_text, liked_at, mime_type, downloaded_at, last_accessed FROM downloads`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query downloads: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make(map[string]CacheEntry)
+	for rows.Next() {
+		var e CacheEntry
+		if err := rows.Scan(&e.Filename, &e.URL, &e.ETag, &e.LastModified, &e.Size, &e.CID, &e.PostCID,
+			&e.PostURI, &e.AuthorDID, &e.AuthorHandle, &e.AltText, &e.LikedAt, &e.MimeType, &e.DownloadedAt, &e.LastAccessed); err != nil {
+			return nil, fmt.Errorf("failed to scan download row: %w", err)
+		}
+		entries[e.Filename] = e
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) Save(entry CacheEntry) error {
+	const upsert = `
+	INSERT INTO downloads (filename, url, etag, last_modified, size, cid, post_cid, post_uri, author_did, author_handle, alt_text, liked_at, mime_type, downloaded_at, last_accessed)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(filename) DO UPDATE SET
+		url=excluded.url, etag=excluded.etag, last_modified=excluded.last_modified, size=excluded.size,
+		cid=excluded.cid, post_cid=excluded.post_cid, post_uri=excluded.post_uri, author_did=excluded.author_did,
+		author_handle=excluded.author_handle, alt_text=excluded.alt_text, liked_at=excluded.liked_at, mime_type=excluded.mime_type,
+		downloaded_at=excluded.downloaded_at, last_accessed=excluded.last_accessed;`
+	_, err := s.db.Exec(upsert, entry.Filename, entry.URL, entry.ETag, entry.LastModified, entry.Size,
+		entry.CID, entry.PostCID, entry.PostURI, entry.AuthorDID, entry.AuthorHandle, entry.AltText, entry.LikedAt, entry.MimeType, entry.DownloadedAt, entry.LastAccessed)
+	if err != nil {
+		return fmt.Errorf("failed to save download entry: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Delete(filename string) error {
+	_, err := s.db.Exec(`DELETE FROM downloads WHERE filename = ?`, filename)
+	if err != nil {
+		return fmt.Errorf("failed to delete download entry %q: %w", filename, err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrateFlatCache imports a legacy cache file (one JSON CacheEntry or bare filename per
+// line, per the pre-sqlite format) into store, then renames it out of the way so this only
+// ever runs once.
+func migrateFlatCache(path string, store Store) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open legacy cache file: %w", err)
+	}
+
+	imported := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			entry = CacheEntry{Filename: line}
+		}
+		if entry.Filename == "" {
+			continue
+		}
+		if err := store.Save(entry); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to migrate cache entry %q: %w", entry.Filename, err)
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read legacy cache file: %w", err)
+	}
+	file.Close()
+
+	if imported > 0 {
+		fmt.Printf("Migrated %d entries from legacy cache file %s into the sqlite store\n", imported, path)
+	}
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		fmt.Printf("Warning: failed to rename legacy cache file after migration: %v\n", err)
+	}
+	return nil
+}
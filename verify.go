@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
+)
+
+// expectedHash pairs a hash.Hash accumulator with the digest we expect it to produce, so
+// verify.go can run several checks (md5, crc32c, ...) over the same stream of bytes in one
+// pass via io.TeeReader/io.MultiWriter.
+type expectedHash struct {
+	name string
+	h    hash.Hash
+	want []byte
+}
+
+// parseContentHashes inspects x-goog-hash, Digest, and Content-MD5 response headers and
+// returns a hash.Hash per recognized digest, pre-loaded with the bytes it should produce.
+// Callers tee the response body through each returned hash.Hash while writing to disk, then
+// call verifyContentHashes once the copy completes.
+func parseContentHashes(header http.Header) []*expectedHash {
+	var checks []*expectedHash
+
+	// x-goog-hash: md5=base64==, crc32c=base64==  (may repeat the header, one pair each)
+	for _, raw := range header.Values("x-goog-hash") {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			want, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "md5":
+				checks = append(checks, &expectedHash{name: "x-goog-hash md5", h: md5.New(), want: want})
+			case "crc32c":
+				checks = append(checks, &expectedHash{name: "x-goog-hash crc32c", h: crc32.New(crc32.MakeTable(crc32.Castagnoli)), want: want})
+			}
+		}
+	}
+
+	// Content-MD5: base64-encoded md5 digest
+	if raw := header.Get("Content-MD5"); raw != "" {
+		if want, err := base64.StdEncoding.DecodeString(raw); err == nil {
+			checks = append(checks, &expectedHash{name: "Content-MD5", h: md5.New(), want: want})
+		}
+	}
+
+	// Digest: md5=base64==, sha-256=base64==
+	if raw := header.Get("Digest"); raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			want, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "md5":
+				checks = append(checks, &expectedHash{name: "Digest md5", h: md5.New(), want: want})
+			case "sha-256":
+				checks = append(checks, &expectedHash{name: "Digest sha-256", h: sha256.New(), want: want})
+			}
+		}
+	}
+
+	return checks
+}
+
+// verifyContentHashes compares each accumulated hash.Hash against its expected digest. It
+// returns the name of the first mismatching check, or "" if everything matched (or there was
+// nothing to check).
+func verifyContentHashes(checks []*expectedHash) (string, error) {
+	for _, c := range checks {
+		got := c.h.Sum(nil)
+		if !hashesEqual(got, c.want) {
+			return c.name, fmt.Errorf("%s mismatch: got %s, want %s", c.name, hex.EncodeToString(got), hex.EncodeToString(c.want))
+		}
+	}
+	return "", nil
+}
+
+func hashesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/JackmanAlex228/LikeLocker/internal/watcher"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// WatchFirehose subscribes to a Jetstream feed filtered to this account's own likes, instead
+// of polling FeedGetActorLikes on an interval. This removes the up-to-POLL_INTERVAL_MINUTES
+// lag and the rate-limit pressure of repeatedly listing the full likes feed, at the cost of a
+// persistent WebSocket connection; watcher.Watcher handles reconnect/backoff and resuming from
+// the last processed commit via cursorFile.
+func (mf *MediaFetcher) WatchFirehose(ctx context.Context, firehoseURL, cursorFile, ntfyTopic string) error {
+	onLike := func(ctx context.Context, postURI string) error {
+		resp, err := bsky.FeedGetPosts(ctx, mf.client, []string{postURI})
+		if err != nil {
+			return fmt.Errorf("failed to resolve liked post %s: %w", postURI, err)
+		}
+		if len(resp.Posts) == 0 {
+			return fmt.Errorf("liked post %s no longer exists", postURI)
+		}
+
+		fmt.Printf("New like: %s\n", postURI)
+		downloaded, err := mf.downloadPostMedia(resp.Posts[0])
+		if err != nil {
+			return fmt.Errorf("failed to download media: %w", err)
+		}
+		if downloaded > 0 {
+			fmt.Printf("Downloaded %d file(s)\n", downloaded)
+			notify(ntfyTopic, fmt.Sprintf("Downloaded %d file(s) from new like", downloaded))
+		}
+		return nil
+	}
+
+	w := watcher.New(firehoseURL, mf.client.Auth.Did, cursorFile, onLike)
+	return w.Run(ctx)
+}